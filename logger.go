@@ -0,0 +1,88 @@
+package ssrpanel
+
+import (
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+)
+
+// Fields carries the structured attributes attached to a single log event,
+// e.g. node_id, user_id, email, uplink, downlink.
+type Fields map[string]interface{}
+
+// Logger is the structured logging interface used throughout the panel. It
+// replaces the ad-hoc newError/newErrorf(...).AtDebug().WriteToLog() calls
+// with leveled, field-based events so operators can ship logs into
+// Loki/ELK and query per-node metrics.
+type Logger interface {
+	WithFields(fields Fields) Logger
+	Debug(event string)
+	Info(event string)
+	Warn(event string)
+	Error(event string, err error)
+}
+
+// defaultLogger is used by any Panel that isn't given one explicitly.
+var defaultLogger Logger = NewLogger("console", "info")
+
+type zerologLogger struct {
+	logger zerolog.Logger
+	fields Fields
+}
+
+// NewLogger builds a Logger backed by zerolog. format is "console" for
+// human-readable output or anything else ("json") for newline-delimited
+// JSON suitable for log shippers. level is one of zerolog's level names
+// (debug, info, warn, error); an unrecognised value falls back to info.
+func NewLogger(format, level string) Logger {
+	var writer = os.Stdout
+	var out zerolog.Logger
+	if strings.EqualFold(format, "console") {
+		out = zerolog.New(zerolog.ConsoleWriter{Out: writer}).With().Timestamp().Logger()
+	} else {
+		out = zerolog.New(writer).With().Timestamp().Logger()
+	}
+
+	lvl, err := zerolog.ParseLevel(strings.ToLower(level))
+	if err != nil || lvl == zerolog.NoLevel {
+		lvl = zerolog.InfoLevel
+	}
+	out = out.Level(lvl)
+
+	return &zerologLogger{logger: out}
+}
+
+func (l *zerologLogger) WithFields(fields Fields) Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &zerologLogger{logger: l.logger, fields: merged}
+}
+
+func (l *zerologLogger) Debug(event string) {
+	l.withContext(l.logger.Debug()).Msg(event)
+}
+
+func (l *zerologLogger) Info(event string) {
+	l.withContext(l.logger.Info()).Msg(event)
+}
+
+func (l *zerologLogger) Warn(event string) {
+	l.withContext(l.logger.Warn()).Msg(event)
+}
+
+func (l *zerologLogger) Error(event string, err error) {
+	l.withContext(l.logger.Error()).Err(err).Msg(event)
+}
+
+func (l *zerologLogger) withContext(e *zerolog.Event) *zerolog.Event {
+	for k, v := range l.fields {
+		e = e.Interface(k, v)
+	}
+	return e
+}
@@ -0,0 +1,93 @@
+// Package metrics exposes the Prometheus series for a running panel process:
+// synced/online user counts, cumulative traffic, cycle duration, and gRPC/DB
+// failure counters, plus a /healthz endpoint orchestrators can poll to
+// restart a stuck panel.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Collector holds every series xray-plugin-srp exports.
+type Collector struct {
+	UsersTotal        *prometheus.GaugeVec
+	UsersOnline       *prometheus.GaugeVec
+	TrafficBytesTotal *prometheus.CounterVec
+	CycleDuration     *prometheus.GaugeVec
+	DBRetryTotal      *prometheus.CounterVec
+	GRPCErrorsTotal   *prometheus.CounterVec
+
+	registry *prometheus.Registry
+}
+
+// NewCollector builds and registers every series on a fresh registry.
+func NewCollector() *Collector {
+	c := &Collector{
+		UsersTotal: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ssrpanel_users_total",
+			Help: "Users currently synced to this node.",
+		}, []string{"node"}),
+		UsersOnline: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ssrpanel_users_online",
+			Help: "Users that reported more than 2048 bytes of traffic in the last cycle.",
+		}, []string{"node"}),
+		TrafficBytesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssrpanel_traffic_bytes_total",
+			Help: "Cumulative traffic reported per user and direction.",
+		}, []string{"node", "direction", "user_email"}),
+		CycleDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "ssrpanel_cycle_duration_seconds",
+			Help: "Wall-clock duration of the last completed cycle.",
+		}, []string{"node"}),
+		DBRetryTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssrpanel_db_retry_total",
+			Help: "Cycles that found the DB connection down.",
+		}, []string{"node"}),
+		GRPCErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ssrpanel_grpc_errors_total",
+			Help: "xray-core gRPC call failures by operation.",
+		}, []string{"op"}),
+		registry: prometheus.NewRegistry(),
+	}
+
+	c.registry.MustRegister(
+		c.UsersTotal,
+		c.UsersOnline,
+		c.TrafficBytesTotal,
+		c.CycleDuration,
+		c.DBRetryTotal,
+		c.GRPCErrorsTotal,
+	)
+
+	return c
+}
+
+// HealthFunc reports whether the panel is healthy. A false result (with a
+// human-readable reason) makes /healthz respond 503.
+type HealthFunc func() (healthy bool, reason string)
+
+// Serve blocks serving /metrics and /healthz on addr until the listener
+// fails or the process exits.
+func (c *Collector) Serve(addr string, health HealthFunc) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(c.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if health == nil {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if ok, reason := health(); !ok {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(reason))
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return http.ListenAndServe(addr, mux)
+}
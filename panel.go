@@ -1,13 +1,18 @@
 package ssrpanel
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
 	"time"
 
 	"code.cloudfoundry.org/bytefmt"
-	"github.com/jinzhu/gorm"
 	"github.com/robfig/cron"
 	"github.com/shirou/gopsutil/load"
+	"github.com/supersongssr/xray-plugin-srp/metrics"
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/proxy/trojan"
@@ -16,84 +21,280 @@ import (
 	"google.golang.org/grpc"
 )
 
+// dbRetryThreshold is how many consecutive failed DB pings /healthz
+// tolerates before reporting the panel unhealthy.
+const dbRetryThreshold = 5
+
+// shutdownTimeout bounds the shutdown-time gRPC calls (the final traffic
+// flush). It's derived from context.Background() rather than Start's ctx,
+// which is already cancelled by the time Shutdown runs; Shutdown's own ctx
+// argument is not used.
+const shutdownTimeout = 10 * time.Second
+
 type Panel struct {
 	*Config
-	handlerServiceClient *HandlerServiceClient
-	statsServiceClient   *StatsServiceClient
-	db                   *DB
-	userModels           []UserModel
-	startAt              time.Time
-	node                 *Node
+	grpcConn              *grpc.ClientConn
+	handlerServiceClients map[string]*HandlerServiceClient // keyed by UserConfig.InboundTag
+	statsServiceClient    *StatsServiceClient
+	repo                  Repository
+	retryTimes            int
+	userModels            map[string][]UserModel // keyed by UserConfig.InboundTag
+	startAt               time.Time
+	node                  *Node
+	cron                  *cron.Cron
+	cycleWG               sync.WaitGroup
+	Logger                Logger
+
+	metrics     *metrics.Collector
+	cycleMu     sync.RWMutex
+	lastCycleAt time.Time
+}
+
+// deadlineTimer arms a context cancellation a fixed duration after it is
+// created, the same approach xray-core's gonet dial adapters use to bound a
+// blocking call instead of letting it run forever. A cycle derives its
+// deadline from CheckRate so a hung xray-core gRPC call can never stall the
+// panel past the next scheduled cycle.
+type deadlineTimer struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newDeadlineTimer(parent context.Context, d time.Duration) *deadlineTimer {
+	ctx, cancel := context.WithTimeout(parent, d)
+	return &deadlineTimer{ctx: ctx, cancel: cancel}
+}
+
+func (t *deadlineTimer) Context() context.Context {
+	return t.ctx
+}
+
+func (t *deadlineTimer) Stop() {
+	t.cancel()
+}
+
+// healthy reports whether /healthz should return 200: the DB hasn't been
+// down for more than dbRetryThreshold consecutive cycles, and the last
+// successful cycle completed within the last two CheckRate windows. Before
+// the first successful cycle only the DB condition is checked.
+func (p *Panel) healthy() (ok bool, reason string) {
+	p.cycleMu.RLock()
+	lastCycleAt := p.lastCycleAt
+	p.cycleMu.RUnlock()
+
+	if p.retryTimes > dbRetryThreshold {
+		return false, "db connection has been down too long"
+	}
+	if !lastCycleAt.IsZero() && time.Since(lastCycleAt) > 2*time.Duration(p.CheckRate)*time.Second {
+		return false, "last successful cycle is stale"
+	}
+	return true, ""
+}
+
+// incGRPCError is a no-op when metrics aren't configured, so call sites
+// don't need to guard every increment.
+func (p *Panel) incGRPCError(op string) {
+	if p.metrics != nil {
+		p.metrics.GRPCErrorsTotal.WithLabelValues(op).Inc()
+	}
 }
 
 func NewPanel(gRPCConn *grpc.ClientConn, db *DB, cfg *Config) (*Panel, error) {
-	node, err := db.GetNode(cfg.NodeID)
+	return NewPanelWithRepository(gRPCConn, NewGormRepository(db), cfg)
+}
+
+// NewPanelWithRepository builds a Panel against an arbitrary Repository,
+// letting tests substitute a MockRepository for the production gorm-backed
+// one without a live database connection.
+func NewPanelWithRepository(gRPCConn *grpc.ClientConn, repo Repository, cfg *Config) (*Panel, error) {
+	node, err := repo.GetNode(cfg.NodeID)
 	if err != nil {
 		return nil, err
 	}
 
-	newErrorf("node[%d] traffic rate %.2f", node.ID, node.TrafficRate).AtDebug().WriteToLog()
+	logger := defaultLogger
+	if cfg.LogFormat != "" || cfg.LogLevel != "" {
+		logger = NewLogger(cfg.LogFormat, cfg.LogLevel)
+	}
+	logger = logger.WithFields(Fields{"node_id": node.ID})
+
+	logger.WithFields(Fields{"traffic_rate": node.TrafficRate}).Debug("node_loaded")
+
+	handlerServiceClients := make(map[string]*HandlerServiceClient, len(cfg.UserConfigs))
+	for _, userCfg := range cfg.UserConfigs {
+		handlerServiceClients[userCfg.InboundTag] = NewHandlerServiceClient(gRPCConn, userCfg.InboundTag)
+	}
+
+	var collector *metrics.Collector
+	if cfg.MetricsAddr != "" {
+		collector = metrics.NewCollector()
+	}
 
 	return &Panel{
-		Config:               cfg,
-		db:                   db,
-		handlerServiceClient: NewHandlerServiceClient(gRPCConn, cfg.UserConfig.InboundTag),
-		statsServiceClient:   NewStatsServiceClient(gRPCConn),
-		startAt:              time.Now(),
-		node:                 node,
+		Config:                cfg,
+		grpcConn:              gRPCConn,
+		repo:                  repo,
+		handlerServiceClients: handlerServiceClients,
+		statsServiceClient:    NewStatsServiceClient(gRPCConn),
+		userModels:            make(map[string][]UserModel, len(cfg.UserConfigs)),
+		startAt:               time.Now(),
+		node:                  node,
+		Logger:                logger,
+		metrics:               collector,
 	}, nil
 }
 
-func (p *Panel) Start() {
+// Start runs the panel's cron loop until ctx is cancelled. On cancellation it
+// stops the scheduler and drains the current cycle, if one is in flight,
+// before returning.
+func (p *Panel) Start(ctx context.Context) {
+	if p.metrics != nil {
+		go func() {
+			if err := p.metrics.Serve(p.MetricsAddr, p.healthy); err != nil && err != http.ErrServerClosed {
+				p.Logger.Error("metrics_server_failed", err)
+			}
+		}()
+	}
+
 	doFunc := func() {
-		if err := p.do(); err != nil {
-			newError("panel#do").Base(err).AtError().WriteToLog()
+		p.cycleWG.Add(1)
+		defer p.cycleWG.Done()
+
+		dt := newDeadlineTimer(ctx, time.Duration(p.CheckRate)*time.Second)
+		defer dt.Stop()
+
+		if err := p.do(dt.Context()); err != nil {
+			p.Logger.Error("cycle_failed", err)
 		}
 	}
 	doFunc()
 
-	c := cron.New()
-	c.AddFunc(fmt.Sprintf("@every %ds", p.CheckRate), doFunc)
-	c.Start()
-	c.Run()
+	p.cron = cron.New()
+	p.cron.AddFunc(fmt.Sprintf("@every %ds", p.CheckRate), doFunc)
+	p.cron.Start()
+
+	<-ctx.Done()
+	p.cron.Stop()
+	p.cycleWG.Wait()
+}
+
+// Shutdown flushes any pending traffic logs, marks the node offline, and
+// closes the underlying gRPC connection. Call it after Start returns.
+//
+// Start only returns once its ctx is cancelled, so by the time Shutdown runs
+// that ctx is already done; the shutdown-time RPCs use their own bounded
+// context derived from context.Background() instead.
+func (p *Panel) Shutdown(ctx context.Context) error {
+	dt := newDeadlineTimer(context.Background(), shutdownTimeout)
+	defer dt.Stop()
+
+	p.flushTrafficLogs(dt.Context())
+
+	if err := p.repo.MarkNodeOffline(p.NodeID); err != nil {
+		p.Logger.Error("shutdown_mark_offline_failed", err)
+	}
+
+	if err := p.statsServiceClient.Close(); err != nil {
+		p.Logger.Error("close_stats_client_failed", err)
+	}
+
+	for tag, client := range p.handlerServiceClients {
+		if err := client.Close(); err != nil {
+			p.Logger.WithFields(Fields{"inbound_tag": tag}).Error("close_handler_client_failed", err)
+		}
+	}
+
+	// handlerServiceClients and statsServiceClient are thin wrappers around
+	// the same shared gRPCConn passed into NewPanelWithRepository; it must be
+	// closed exactly once here, not once per inbound.
+	if p.grpcConn != nil {
+		if err := p.grpcConn.Close(); err != nil {
+			p.Logger.Error("close_grpc_conn_failed", err)
+		}
+	}
+
+	return nil
+}
+
+// flushTrafficLogs persists one last round of rate-adjusted traffic before
+// the panel exits, so usage between the final cron tick and process exit
+// isn't silently dropped.
+func (p *Panel) flushTrafficLogs(ctx context.Context) {
+	userTrafficLogs, err := p.getTraffic(ctx)
+	if err != nil {
+		p.Logger.Error("shutdown_flush_traffic_failed", err)
+		return
+	}
+
+	for i := range userTrafficLogs {
+		log := &userTrafficLogs[i]
+		log.Uplink = p.mulTrafficRate(log.Uplink)
+		log.Downlink = p.mulTrafficRate(log.Downlink)
+		log.Traffic = bytefmt.ByteSize(log.Uplink + log.Downlink)
+	}
+
+	if err := p.repo.BatchCreateTrafficLogs(asUserTrafficLogs(userTrafficLogs)); err != nil {
+		p.Logger.Error("shutdown_flush_traffic_failed", err)
+	}
 }
 
-func (p *Panel) do() error {
+func (p *Panel) do(ctx context.Context) (err error) {
 	var addedUserCount, deletedUserCount, onlineUsers int
 	var uplinkTotal, downlinkTotal uint64
-
-	if err := p.db.DB.DB().Ping(); err != nil {
-		p.db.RetryTimes++
-		newErrorf("Lost db connection, retry times: %d",
-			p.db.RetryTimes).AtDebug().WriteToLog()
+	cycleStart := time.Now()
+	node := strconv.Itoa(p.NodeID)
+
+	if err := p.repo.Ping(); err != nil {
+		p.retryTimes++
+		p.Logger.WithFields(Fields{"retry_times": p.retryTimes}).Debug("db_connection_lost")
+		if p.metrics != nil {
+			p.metrics.DBRetryTotal.WithLabelValues(node).Inc()
+		}
 		return nil
 	}
-	p.db.RetryTimes = 0
+	p.retryTimes = 0
 
 	defer func() {
-		newErrorf("+ %d users, - %d users, ↓ %s, ↑ %s, online %d",
-			addedUserCount, deletedUserCount, bytefmt.ByteSize(downlinkTotal), bytefmt.ByteSize(uplinkTotal), onlineUsers).AtDebug().WriteToLog()
+		p.Logger.WithFields(Fields{
+			"added":    addedUserCount,
+			"deleted":  deletedUserCount,
+			"online":   onlineUsers,
+			"uplink":   uplinkTotal,
+			"downlink": downlinkTotal,
+		}).Debug("cycle_complete")
+
+		if p.metrics != nil {
+			p.metrics.CycleDuration.WithLabelValues(node).Set(time.Since(cycleStart).Seconds())
+			p.metrics.UsersTotal.WithLabelValues(node).Set(float64(len(p.allUsers())))
+			p.metrics.UsersOnline.WithLabelValues(node).Set(float64(onlineUsers))
+		}
+
+		if err == nil {
+			p.cycleMu.Lock()
+			p.lastCycleAt = time.Now()
+			p.cycleMu.Unlock()
+		}
 	}()
 
-	if err := p.db.DB.Create(&NodeInfo{
+	if err := p.repo.CreateNodeInfo(&NodeInfo{
 		NodeID: p.NodeID,
 		Uptime: time.Now().Sub(p.startAt) / time.Second,
 		Load:   getSystemLoad(),
-	}).Error; err != nil {
+	}); err != nil {
 		return err
 	}
 
-	userTrafficLogs, err := p.getTraffic()
+	userTrafficLogs, err := p.getTraffic(ctx)
 	if err != nil {
 		return err
 	}
-	// onlineUsers = len(userTrafficLogs)
 	onlineUsers = 0
 
 	var uVals, dVals string
 	var userIDs []uint
 
-	for _, log := range userTrafficLogs {
+	for i := range userTrafficLogs {
+		log := &userTrafficLogs[i]
 		uplink := p.mulTrafficRate(log.Uplink)
 		downlink := p.mulTrafficRate(log.Downlink)
 
@@ -105,31 +306,49 @@ func (p *Panel) do() error {
 		downlinkTotal += log.Downlink
 
 		log.Traffic = bytefmt.ByteSize(uplink + downlink)
-		p.db.DB.Create(&log.UserTrafficLog)
+		log.Uplink = uplink
+		log.Downlink = downlink
 
 		userIDs = append(userIDs, log.UserID)
 		uVals += fmt.Sprintf(" WHEN %d THEN u + %d", log.UserID, uplink)
 		dVals += fmt.Sprintf(" WHEN %d THEN d + %d", log.UserID, downlink)
+
+		if p.metrics != nil {
+			if user, ok := p.findUserByID(log.UserID); ok {
+				p.metrics.TrafficBytesTotal.WithLabelValues(node, "uplink", user.Email).Add(float64(uplink))
+				p.metrics.TrafficBytesTotal.WithLabelValues(node, "downlink", user.Email).Add(float64(downlink))
+			}
+		}
+	}
+
+	if err := p.repo.BatchCreateTrafficLogs(asUserTrafficLogs(userTrafficLogs)); err != nil {
+		p.Logger.Error("create_traffic_logs_failed", err)
 	}
 
 	if onlineUsers > 0 {
-		p.db.DB.Create(&NodeOnlineLog{
+		p.repo.CreateNodeOnlineLog(&NodeOnlineLog{
 			NodeID:     p.NodeID,
 			OnlineUser: onlineUsers,
 		})
 	}
 
 	if uVals != "" && dVals != "" {
-		p.db.DB.Table("user").
-			Where("id in (?)", userIDs).
-			Updates(map[string]interface{}{
-				"u": gorm.Expr(fmt.Sprintf("CASE id %s END", uVals)),
-				"d": gorm.Expr(fmt.Sprintf("CASE id %s END", dVals)),
-				"t": time.Now().Unix(),
-			})
+		if err := p.repo.UpdateUserTraffic(userIDs, uVals, dVals); err != nil {
+			p.Logger.Error("update_user_traffic_failed", err)
+		}
+	}
+
+	if err := p.trackOnlineIPs(ctx); err != nil {
+		p.Logger.Error("track_online_ips_failed", err)
 	}
 
-	addedUserCount, deletedUserCount, err = p.syncUser()
+	disabledUserCount, _, err := p.enforceQuota(ctx)
+	if err != nil {
+		p.Logger.Error("enforce_quota_failed", err)
+	}
+
+	addedUserCount, deletedUserCount, err = p.syncUser(ctx)
+	deletedUserCount += disabledUserCount
 	return nil
 }
 
@@ -138,105 +357,361 @@ type userStatsLogs struct {
 	UserPort int
 }
 
-func (p *Panel) getTraffic() (logs []userStatsLogs, err error) {
-	var downlink, uplink uint64
-	for _, user := range p.userModels {
-		downlink, err = p.statsServiceClient.getUserDownlink(user.Email)
-		if err != nil {
-			return
+// trafficStatsRegexp matches xray-core's stats naming convention for the
+// per-user uplink/downlink counters, e.g. "user>>>alice@example.com>>>traffic>>>uplink".
+var trafficStatsRegexp = regexp.MustCompile(`^user>>>([^>]+)>>>traffic>>>(uplink|downlink)$`)
+
+func (p *Panel) getTraffic(ctx context.Context) (logs []userStatsLogs, err error) {
+	stats, err := p.statsServiceClient.QueryStats(ctx, `^user>>>.+>>>traffic>>>(uplink|downlink)$`)
+	if err != nil {
+		p.incGRPCError("query_stats")
+		return nil, err
+	}
+
+	type userTraffic struct {
+		uplink, downlink uint64
+	}
+	traffics := make(map[string]*userTraffic)
+
+	for _, stat := range stats {
+		matches := trafficStatsRegexp.FindStringSubmatch(stat.Name)
+		if matches == nil {
+			continue
 		}
 
-		uplink, err = p.statsServiceClient.getUserUplink(user.Email)
-		if err != nil {
-			return
+		t, ok := traffics[matches[1]]
+		if !ok {
+			t = &userTraffic{}
+			traffics[matches[1]] = t
 		}
 
-		if uplink+downlink > 0 {
-			if err != nil {
-				return
-			}
+		switch matches[2] {
+		case "uplink":
+			t.uplink += uint64(stat.Value)
+		case "downlink":
+			t.downlink += uint64(stat.Value)
+		}
+	}
 
-			logs = append(logs, userStatsLogs{
-				UserTrafficLog: UserTrafficLog{
-					UserID:   user.ID,
-					Uplink:   uplink,
-					Downlink: downlink,
-					NodeID:   p.NodeID,
-					Rate:     p.node.TrafficRate,
-				},
-				UserPort: user.Port,
-			})
+	// A user may be present on more than one inbound (e.g. VLESS and Trojan on
+	// the same node); allUsers() dedupes so their traffic is only written once.
+	for _, user := range p.allUsers() {
+		t, ok := traffics[user.Email]
+		if !ok || t.uplink+t.downlink == 0 {
+			continue
 		}
+
+		logs = append(logs, userStatsLogs{
+			UserTrafficLog: UserTrafficLog{
+				UserID:   user.ID,
+				Uplink:   t.uplink,
+				Downlink: t.downlink,
+				NodeID:   p.NodeID,
+				Rate:     p.node.TrafficRate,
+			},
+			UserPort: user.Port,
+		})
 	}
 
 	return
 }
 
+// asUserTrafficLogs strips the in-memory-only UserPort field so the batch
+// can be handed to the Repository, which only knows about persisted columns.
+func asUserTrafficLogs(logs []userStatsLogs) []UserTrafficLog {
+	out := make([]UserTrafficLog, 0, len(logs))
+	for _, log := range logs {
+		out = append(out, log.UserTrafficLog)
+	}
+	return out
+}
+
 func (p *Panel) mulTrafficRate(traffic uint64) uint64 {
 	return uint64(p.node.TrafficRate * float64(traffic))
 }
 
-func (p *Panel) syncUser() (addedUserCount, deletedUserCount int, err error) {
-	userModels, err := p.db.GetAllUsers(p.NodeID)
+// enforceQuota disables every user whose consumed traffic has exceeded their
+// transfer_enable quota or whose class has expired, and reports how many were
+// removed (and their emails, for logging) so the caller can fold the count
+// into deletedUserCount.
+//
+// Disabling only mutates p.userModels and xray-core's own user tables, not
+// the DB row backing quotas/GetAllUsers, and it's not the only thing keeping
+// a disabled user out: syncUser re-derives the same quota/expiry check from
+// the DB on every cycle (see quotaDisabledEmails) so the user stays excluded
+// for as long as their quota/expiry condition holds, not just the one cycle
+// enforceQuota happens to still remember them.
+func (p *Panel) enforceQuota(ctx context.Context) (disabledUserCount int, disabledEmails []string, err error) {
+	quotas, err := p.repo.GetUserQuotas(p.NodeID)
 	if err != nil {
-		return 0, 0, err
+		return 0, nil, err
 	}
-	if len(userModels) == 0 {
-		return 0, 0, err
+
+	now := time.Now().Unix()
+	for _, quota := range quotas {
+		expired, overQuota := quotaExceeded(quota, now)
+		if !expired && !overQuota {
+			continue
+		}
+
+		user, ok := p.findUserByID(quota.UserID)
+		if !ok {
+			continue
+		}
+
+		if !p.removeUserFromAllInbounds(ctx, user.Email) {
+			continue
+		}
+		disabledUserCount++
+		disabledEmails = append(disabledEmails, user.Email)
+		p.Logger.WithFields(Fields{
+			"user_id": user.ID, "email": user.Email, "expired": expired, "over_quota": overQuota,
+		}).Debug("user_disabled")
 	}
 
-	// Calculate addition users
-	addUserModels := make([]UserModel, 0)
-	for _, userModel := range userModels {
-		if inUserModels(&userModel, p.userModels) {
+	return
+}
+
+// quotaExceeded reports why, if at all, quota should trigger a disable: its
+// class has expired as of now, or its consumed traffic has reached its
+// transfer_enable limit. A zero ClassExpire/TransferEnable means "no limit".
+func quotaExceeded(quota UserQuota, now int64) (expired, overQuota bool) {
+	expired = quota.ClassExpire > 0 && quota.ClassExpire < now
+	overQuota = quota.TransferEnable > 0 && quota.Used >= quota.TransferEnable
+	return
+}
+
+// quotaDisabledEmails re-derives, from the DB's current quota/expiry state,
+// which of dbUserModels syncUser must not re-add this cycle. It's the same
+// check enforceQuota runs, kept independent and re-evaluated every call so a
+// user stays excluded for as long as their quota/expiry condition holds
+// rather than only the one cycle enforceQuota happens to still have them in
+// p.userModels.
+func (p *Panel) quotaDisabledEmails(dbUserModels []UserModel) ([]string, error) {
+	quotas, err := p.repo.GetUserQuotas(p.NodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	emailByID := make(map[uint]string, len(dbUserModels))
+	for _, userModel := range dbUserModels {
+		emailByID[userModel.ID] = userModel.Email
+	}
+
+	now := time.Now().Unix()
+	var disabled []string
+	for _, quota := range quotas {
+		expired, overQuota := quotaExceeded(quota, now)
+		if !expired && !overQuota {
 			continue
 		}
+		if email, ok := emailByID[quota.UserID]; ok {
+			disabled = append(disabled, email)
+		}
+	}
+	return disabled, nil
+}
 
-		addUserModels = append(addUserModels, userModel)
+// trackOnlineIPs records every distinct client IP xray-core currently sees per
+// user into the AliveIP table and kicks sessions once node_ip_limit is
+// exceeded.
+func (p *Panel) trackOnlineIPs(ctx context.Context) error {
+	onlineIPs, err := p.statsServiceClient.GetOnlineIPs(ctx)
+	if err != nil {
+		p.incGRPCError("get_online_ips")
+		return err
 	}
 
-	// Calculate deletion users
-	delUserModels := make([]UserModel, 0)
-	for _, userModel := range p.userModels {
-		if inUserModels(&userModel, userModels) {
+	for email, ips := range onlineIPs {
+		user, ok := p.findUserByEmail(email)
+		if !ok {
 			continue
 		}
 
-		delUserModels = append(delUserModels, userModel)
+		if p.node.IPLimit > 0 && len(ips) > p.node.IPLimit {
+			p.Logger.WithFields(Fields{
+				"email": email, "ip_count": len(ips), "ip_limit": p.node.IPLimit,
+			}).Warn("ip_limit_exceeded")
+			if p.removeUserFromAllInbounds(ctx, email) {
+				p.addUserToAllInbounds(ctx, user)
+			}
+		}
+
+		seen := make([]AliveIP, 0, len(ips))
+		for _, ip := range ips {
+			seen = append(seen, AliveIP{
+				UserID: user.ID,
+				NodeID: p.NodeID,
+				IP:     ip,
+				SeenAt: time.Now(),
+			})
+		}
+		if err := p.repo.CreateOnlineIPs(seen); err != nil {
+			p.Logger.WithFields(Fields{"email": email}).Error("create_online_ips_failed", err)
+		}
 	}
 
+	return nil
+}
+
+// syncUser reconciles xray-core's per-inbound user tables against the DB's
+// view of who belongs on this node, once per configured inbound so a single
+// panel process can serve VLESS, Trojan, and VMess simultaneously.
+//
+// GetAllUsers still returns the row for a user enforceQuota has disabled
+// this cycle or a previous one — the DB's quota/expiry state is what
+// enforceQuota checks, not a disabled flag it sets — so syncUser re-derives
+// the same quota/expiry check on every call via quotaDisabledEmails and
+// filters those users out before diffing, rather than treating them as
+// newly added and re-adding them via AddUser.
+func (p *Panel) syncUser(ctx context.Context) (addedUserCount, deletedUserCount int, err error) {
+	dbUserModels, err := p.repo.GetAllUsers(p.NodeID)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(dbUserModels) == 0 {
+		return 0, 0, err
+	}
+
+	skipEmails, quotaErr := p.quotaDisabledEmails(dbUserModels)
+	if quotaErr != nil {
+		p.Logger.Error("quota_disabled_lookup_failed", quotaErr)
+	}
+	dbUserModels = excludeByEmail(dbUserModels, skipEmails)
+
+	for _, userCfg := range p.UserConfigs {
+		added, deleted, syncErr := p.syncInboundUsers(ctx, userCfg, dbUserModels)
+		addedUserCount += added
+		deletedUserCount += deleted
+		if syncErr != nil {
+			err = syncErr
+			return
+		}
+	}
+
+	return
+}
+
+// syncInboundUsers adds/removes users on a single inbound tag, leaving the
+// other inbounds' user tables untouched.
+func (p *Panel) syncInboundUsers(ctx context.Context, userCfg UserConfig, dbUserModels []UserModel) (addedUserCount, deletedUserCount int, err error) {
+	tag := userCfg.InboundTag
+	client := p.handlerServiceClients[tag]
+	current := p.userModels[tag]
+
+	addUserModels, delUserModels := diffUserModels(dbUserModels, current)
+
 	// Delete
 	for _, userModel := range delUserModels {
-		if i := findUserModelIndex(&userModel, p.userModels); i != -1 {
-			p.userModels = append(p.userModels[:i], p.userModels[i+1:]...)
-			if err = p.handlerServiceClient.DelUser(userModel.Email); err != nil {
+		if i := findUserModelIndex(&userModel, current); i != -1 {
+			current = append(current[:i], current[i+1:]...)
+			if err = client.DelUser(ctx, userModel.Email); err != nil {
+				p.incGRPCError("del_user")
+				p.userModels[tag] = current
 				return
 			}
 			deletedUserCount++
-			newErrorf("Deleted user: id=%d, VmessID=%s, Email=%s", userModel.ID, userModel.VmessID, userModel.Email).AtDebug().WriteToLog()
+			p.Logger.WithFields(Fields{
+				"inbound_tag": tag, "user_id": userModel.ID, "email": userModel.Email,
+			}).Debug("user_deleted")
 		}
 	}
 
 	// Add
 	for _, userModel := range addUserModels {
-		if err = p.handlerServiceClient.AddUser(p.convertUser(userModel)); err != nil {
+		if err = client.AddUser(ctx, p.convertUser(userModel, userCfg)); err != nil {
+			p.incGRPCError("add_user")
 			if p.IgnoreEmptyVmessID {
-				newErrorf("add user err \"%s\" user: %#v", err, userModel).AtWarning().WriteToLog()
+				p.Logger.WithFields(Fields{"inbound_tag": tag, "user_id": userModel.ID, "email": userModel.Email}).Error("add_user_failed", err)
+				err = nil
 				continue
 			}
+			p.userModels[tag] = current
 			fatal("add user err ", err, userModel)
 		}
-		p.userModels = append(p.userModels, userModel)
+		current = append(current, userModel)
 		addedUserCount++
-		newErrorf("Added user: id=%d, VmessID=%s, Email=%s", userModel.ID, userModel.VmessID, userModel.Email).AtDebug().WriteToLog()
+		p.Logger.WithFields(Fields{
+			"inbound_tag": tag, "user_id": userModel.ID, "email": userModel.Email,
+		}).Debug("user_added")
 	}
 
+	p.userModels[tag] = current
 	return
 }
 
-func (p *Panel) convertUser(userModel UserModel) *protocol.User {
-	userCfg := p.UserConfig
-	inbound := getInboundConfigByTag(p.UserConfig.InboundTag, p.v2rayConfig.InboundConfigs)
+// removeUserFromAllInbounds deletes email from every inbound that currently
+// serves it, reporting whether it was found (and removed) on at least one.
+func (p *Panel) removeUserFromAllInbounds(ctx context.Context, email string) (removed bool) {
+	for tag, users := range p.userModels {
+		i := findUserModelIndexByEmail(email, users)
+		if i == -1 {
+			continue
+		}
+
+		if err := p.handlerServiceClients[tag].DelUser(ctx, email); err != nil {
+			p.incGRPCError("del_user")
+			p.Logger.WithFields(Fields{"inbound_tag": tag, "email": email}).Error("del_user_failed", err)
+			continue
+		}
+		p.userModels[tag] = append(users[:i], users[i+1:]...)
+		removed = true
+	}
+	return
+}
+
+// addUserToAllInbounds adds user to every inbound configured for this panel,
+// e.g. to restore it after a forced removal.
+func (p *Panel) addUserToAllInbounds(ctx context.Context, user UserModel) {
+	for _, userCfg := range p.UserConfigs {
+		tag := userCfg.InboundTag
+		if err := p.handlerServiceClients[tag].AddUser(ctx, p.convertUser(user, userCfg)); err != nil {
+			p.incGRPCError("add_user")
+			p.Logger.WithFields(Fields{"inbound_tag": tag, "user_id": user.ID, "email": user.Email}).Error("readd_user_failed", err)
+			continue
+		}
+		p.userModels[tag] = append(p.userModels[tag], user)
+	}
+}
+
+// allUsers returns the union of every inbound's user list, deduped by email,
+// for operations (traffic aggregation, quota checks) that apply per user
+// rather than per inbound.
+func (p *Panel) allUsers() []UserModel {
+	seen := make(map[string]bool)
+	var all []UserModel
+	for _, users := range p.userModels {
+		for _, user := range users {
+			if seen[user.Email] {
+				continue
+			}
+			seen[user.Email] = true
+			all = append(all, user)
+		}
+	}
+	return all
+}
+
+func (p *Panel) findUserByID(id uint) (UserModel, bool) {
+	for _, users := range p.userModels {
+		if i := findUserModelIndexByID(id, users); i != -1 {
+			return users[i], true
+		}
+	}
+	return UserModel{}, false
+}
+
+func (p *Panel) findUserByEmail(email string) (UserModel, bool) {
+	for _, users := range p.userModels {
+		if i := findUserModelIndexByEmail(email, users); i != -1 {
+			return users[i], true
+		}
+	}
+	return UserModel{}, false
+}
+
+func (p *Panel) convertUser(userModel UserModel, userCfg UserConfig) *protocol.User {
+	inbound := getInboundConfigByTag(userCfg.InboundTag, p.v2rayConfig.InboundConfigs)
 	if inbound.Protocol == "vless" {
 		return &protocol.User{
 			Level: userCfg.Level,
@@ -275,10 +750,74 @@ func findUserModelIndex(u *UserModel, userModels []UserModel) int {
 	return -1
 }
 
+func findUserModelIndexByID(id uint, userModels []UserModel) int {
+	for i, user := range userModels {
+		if user.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func findUserModelIndexByEmail(email string, userModels []UserModel) int {
+	for i, user := range userModels {
+		if user.Email == email {
+			return i
+		}
+	}
+	return -1
+}
+
 func inUserModels(u *UserModel, userModels []UserModel) bool {
 	return findUserModelIndex(u, userModels) != -1
 }
 
+// diffUserModels compares dbUserModels (who should be on this inbound,
+// usually after excludeByEmail has dropped quota-disabled users) against
+// current (who xray-core actually has loaded), returning who to add and who
+// to delete to reconcile the two.
+func diffUserModels(dbUserModels, current []UserModel) (addUserModels, delUserModels []UserModel) {
+	addUserModels = make([]UserModel, 0)
+	for _, userModel := range dbUserModels {
+		if inUserModels(&userModel, current) {
+			continue
+		}
+		addUserModels = append(addUserModels, userModel)
+	}
+
+	delUserModels = make([]UserModel, 0)
+	for _, userModel := range current {
+		if inUserModels(&userModel, dbUserModels) {
+			continue
+		}
+		delUserModels = append(delUserModels, userModel)
+	}
+
+	return
+}
+
+// excludeByEmail returns userModels with every entry whose Email appears in
+// skipEmails removed. A nil/empty skipEmails returns userModels unchanged.
+func excludeByEmail(userModels []UserModel, skipEmails []string) []UserModel {
+	if len(skipEmails) == 0 {
+		return userModels
+	}
+
+	skip := make(map[string]bool, len(skipEmails))
+	for _, email := range skipEmails {
+		skip[email] = true
+	}
+
+	filtered := make([]UserModel, 0, len(userModels))
+	for _, userModel := range userModels {
+		if skip[userModel.Email] {
+			continue
+		}
+		filtered = append(filtered, userModel)
+	}
+	return filtered
+}
+
 func getSystemLoad() string {
 	stat, err := load.Avg()
 	if err != nil {
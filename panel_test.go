@@ -0,0 +1,246 @@
+package ssrpanel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMulTrafficRate(t *testing.T) {
+	p := &Panel{node: &Node{TrafficRate: 1.5}}
+
+	if got, want := p.mulTrafficRate(1000), uint64(1500); got != want {
+		t.Errorf("mulTrafficRate(1000) = %d, want %d", got, want)
+	}
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	const now = int64(1000)
+
+	cases := []struct {
+		name          string
+		quota         UserQuota
+		wantExpired   bool
+		wantOverQuota bool
+	}{
+		{
+			name:  "within limits",
+			quota: UserQuota{ClassExpire: now + 100, TransferEnable: 100, Used: 50},
+		},
+		{
+			name:        "class expired",
+			quota:       UserQuota{ClassExpire: now - 1, TransferEnable: 100, Used: 50},
+			wantExpired: true,
+		},
+		{
+			name:          "over quota",
+			quota:         UserQuota{ClassExpire: now + 100, TransferEnable: 100, Used: 100},
+			wantOverQuota: true,
+		},
+		{
+			name:  "unlimited class and quota",
+			quota: UserQuota{ClassExpire: 0, TransferEnable: 0, Used: 1 << 30},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expired, overQuota := quotaExceeded(tc.quota, now)
+			if expired != tc.wantExpired || overQuota != tc.wantOverQuota {
+				t.Errorf("quotaExceeded(%+v, %d) = (%v, %v), want (%v, %v)",
+					tc.quota, now, expired, overQuota, tc.wantExpired, tc.wantOverQuota)
+			}
+		})
+	}
+}
+
+func TestExcludeByEmail(t *testing.T) {
+	users := []UserModel{
+		{ID: 1, Email: "alice@example.com"},
+		{ID: 2, Email: "bob@example.com"},
+		{ID: 3, Email: "carol@example.com"},
+	}
+
+	got := excludeByEmail(users, []string{"bob@example.com"})
+	want := []UserModel{
+		{ID: 1, Email: "alice@example.com"},
+		{ID: 3, Email: "carol@example.com"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("excludeByEmail() = %+v, want %+v", got, want)
+	}
+
+	if got := excludeByEmail(users, nil); !reflect.DeepEqual(got, users) {
+		t.Errorf("excludeByEmail(nil) should return the input unchanged, got %+v", got)
+	}
+}
+
+func TestAsUserTrafficLogs(t *testing.T) {
+	logs := []userStatsLogs{
+		{UserTrafficLog: UserTrafficLog{UserID: 1, Uplink: 10, Downlink: 20}, UserPort: 443},
+		{UserTrafficLog: UserTrafficLog{UserID: 2, Uplink: 30, Downlink: 40}, UserPort: 8443},
+	}
+
+	got := asUserTrafficLogs(logs)
+	want := []UserTrafficLog{
+		{UserID: 1, Uplink: 10, Downlink: 20},
+		{UserID: 2, Uplink: 30, Downlink: 40},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("asUserTrafficLogs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestDiffUserModels(t *testing.T) {
+	alice := UserModel{ID: 1, Email: "alice@example.com"}
+	bob := UserModel{ID: 2, Email: "bob@example.com"}
+	carol := UserModel{ID: 3, Email: "carol@example.com"}
+
+	addUserModels, delUserModels := diffUserModels(
+		[]UserModel{alice, carol}, // dbUserModels: who should be present
+		[]UserModel{alice, bob},   // current: who xray-core actually has
+	)
+
+	if !reflect.DeepEqual(addUserModels, []UserModel{carol}) {
+		t.Errorf("addUserModels = %+v, want %+v", addUserModels, []UserModel{carol})
+	}
+	if !reflect.DeepEqual(delUserModels, []UserModel{bob}) {
+		t.Errorf("delUserModels = %+v, want %+v", delUserModels, []UserModel{bob})
+	}
+}
+
+// TestSyncReconciliationAcrossQuotaCycle drives the add/delete reconciliation
+// diffUserModels feeds syncInboundUsers through the exact multi-cycle
+// scenario the chunk0-1 regression covers: a MockRepository whose
+// GetAllUsers never stops returning a quota-exceeded user (their DB row
+// never changes), combined with GetUserQuotas reporting them over quota on
+// every call. Without re-deriving the quota-disabled set on every cycle
+// (quotaDisabledEmails), the user xray-core just dropped would show back up
+// in dbUserModels and get added right back.
+func TestSyncReconciliationAcrossQuotaCycle(t *testing.T) {
+	alice := UserModel{ID: 1, Email: "alice@example.com"}
+	bob := UserModel{ID: 2, Email: "bob@example.com"}
+
+	bobOverQuota := true
+	repo := &MockRepository{
+		GetAllUsersFunc: func(nodeID int) ([]UserModel, error) {
+			return []UserModel{alice, bob}, nil
+		},
+		GetUserQuotasFunc: func(nodeID int) ([]UserQuota, error) {
+			used := uint64(0)
+			if bobOverQuota {
+				used = 1000
+			}
+			return []UserQuota{
+				{UserID: bob.ID, TransferEnable: 1000, Used: used},
+			}, nil
+		},
+	}
+	p := &Panel{Config: &Config{}, repo: repo}
+
+	// Cycle 1: xray-core currently has both users loaded; bob is already
+	// over quota, so this cycle's reconciliation must delete him.
+	current := []UserModel{alice, bob}
+	dbUserModels, err := repo.GetAllUsers(0)
+	if err != nil {
+		t.Fatalf("GetAllUsers() error = %v", err)
+	}
+	skipEmails, err := p.quotaDisabledEmails(dbUserModels)
+	if err != nil {
+		t.Fatalf("quotaDisabledEmails() error = %v", err)
+	}
+	addUserModels, delUserModels := diffUserModels(excludeByEmail(dbUserModels, skipEmails), current)
+	if len(addUserModels) != 0 {
+		t.Fatalf("cycle 1: addUserModels = %+v, want none", addUserModels)
+	}
+	if !reflect.DeepEqual(delUserModels, []UserModel{bob}) {
+		t.Fatalf("cycle 1: delUserModels = %+v, want %+v", delUserModels, []UserModel{bob})
+	}
+	current = []UserModel{alice} // bob deleted
+
+	// Cycle 2: bob's DB row still shows him over quota (nothing persisted
+	// the disable), but he must stay excluded instead of being re-added.
+	dbUserModels, err = repo.GetAllUsers(0)
+	if err != nil {
+		t.Fatalf("GetAllUsers() error = %v", err)
+	}
+	skipEmails, err = p.quotaDisabledEmails(dbUserModels)
+	if err != nil {
+		t.Fatalf("quotaDisabledEmails() error = %v", err)
+	}
+	addUserModels, delUserModels = diffUserModels(excludeByEmail(dbUserModels, skipEmails), current)
+	if len(addUserModels) != 0 {
+		t.Fatalf("cycle 2: bob was re-added, addUserModels = %+v, want none", addUserModels)
+	}
+	if len(delUserModels) != 0 {
+		t.Fatalf("cycle 2: delUserModels = %+v, want none", delUserModels)
+	}
+
+	// Cycle 3: bob's quota clears, so he should legitimately be added back.
+	bobOverQuota = false
+	dbUserModels, err = repo.GetAllUsers(0)
+	if err != nil {
+		t.Fatalf("GetAllUsers() error = %v", err)
+	}
+	skipEmails, err = p.quotaDisabledEmails(dbUserModels)
+	if err != nil {
+		t.Fatalf("quotaDisabledEmails() error = %v", err)
+	}
+	addUserModels, delUserModels = diffUserModels(excludeByEmail(dbUserModels, skipEmails), current)
+	if !reflect.DeepEqual(addUserModels, []UserModel{bob}) {
+		t.Fatalf("cycle 3: addUserModels = %+v, want %+v", addUserModels, []UserModel{bob})
+	}
+	if len(delUserModels) != 0 {
+		t.Fatalf("cycle 3: delUserModels = %+v, want none", delUserModels)
+	}
+}
+
+// TestSyncUserNoUsers exercises syncUser against a MockRepository to confirm
+// it goes straight to the GetAllUsers call and returns early without
+// touching any inbound when the DB reports no users for this node.
+func TestSyncUserNoUsers(t *testing.T) {
+	calls := 0
+	repo := &MockRepository{
+		GetAllUsersFunc: func(nodeID int) ([]UserModel, error) {
+			calls++
+			return nil, nil
+		},
+	}
+
+	p := &Panel{Config: &Config{}, repo: repo}
+
+	addedUserCount, deletedUserCount, err := p.syncUser(nil)
+	if err != nil {
+		t.Fatalf("syncUser() error = %v", err)
+	}
+	if addedUserCount != 0 || deletedUserCount != 0 {
+		t.Fatalf("syncUser() with no DB users = (%d, %d), want (0, 0)", addedUserCount, deletedUserCount)
+	}
+	if calls != 1 {
+		t.Fatalf("GetAllUsers called %d times, want 1", calls)
+	}
+}
+
+// TestEnforceQuotaNoneExceeded exercises enforceQuota against a
+// MockRepository to confirm it leaves users alone when neither their class
+// has expired nor their quota is exhausted.
+func TestEnforceQuotaNoneExceeded(t *testing.T) {
+	repo := &MockRepository{
+		GetUserQuotasFunc: func(nodeID int) ([]UserQuota, error) {
+			return []UserQuota{
+				{UserID: 1, ClassExpire: 0, TransferEnable: 0, Used: 1 << 30},
+			}, nil
+		},
+	}
+
+	p := &Panel{Config: &Config{}, repo: repo}
+
+	disabledUserCount, disabledEmails, err := p.enforceQuota(nil)
+	if err != nil {
+		t.Fatalf("enforceQuota() error = %v", err)
+	}
+	if disabledUserCount != 0 || disabledEmails != nil {
+		t.Fatalf("enforceQuota() = (%d, %v), want (0, nil)", disabledUserCount, disabledEmails)
+	}
+}
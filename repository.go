@@ -0,0 +1,110 @@
+package ssrpanel
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Repository abstracts every database operation Panel needs. Depending on
+// this interface instead of a concrete *DB lets syncUser, mulTrafficRate,
+// quota enforcement, and traffic aggregation run against a mock in tests
+// without a live Postgres/MySQL connection.
+type Repository interface {
+	Ping() error
+	CreateNodeInfo(info *NodeInfo) error
+	BatchCreateTrafficLogs(logs []UserTrafficLog) error
+	CreateNodeOnlineLog(log *NodeOnlineLog) error
+	CreateOnlineIPs(ips []AliveIP) error
+	UpdateUserTraffic(userIDs []uint, uplinkCase, downlinkCase string) error
+	GetAllUsers(nodeID int) ([]UserModel, error)
+	GetUserQuotas(nodeID int) ([]UserQuota, error)
+	GetNode(nodeID int) (*Node, error)
+	MarkNodeOffline(nodeID int) error
+}
+
+// gormRepository is the production Repository, backed by the existing *DB
+// gorm wrapper.
+type gormRepository struct {
+	db *DB
+}
+
+// NewGormRepository wraps an existing *DB as a Repository.
+func NewGormRepository(db *DB) Repository {
+	return &gormRepository{db: db}
+}
+
+func (r *gormRepository) Ping() error {
+	return r.db.DB.DB().Ping()
+}
+
+func (r *gormRepository) CreateNodeInfo(info *NodeInfo) error {
+	return r.db.DB.Create(info).Error
+}
+
+func (r *gormRepository) BatchCreateTrafficLogs(logs []UserTrafficLog) error {
+	if len(logs) == 0 {
+		return nil
+	}
+
+	placeholders := make([]string, 0, len(logs))
+	values := make([]interface{}, 0, len(logs)*5)
+	for _, log := range logs {
+		placeholders = append(placeholders, "(?, ?, ?, ?, ?)")
+		values = append(values, log.UserID, log.NodeID, log.Uplink, log.Downlink, log.Rate)
+	}
+
+	sql := fmt.Sprintf(
+		"INSERT INTO user_traffic_log (user_id, node_id, uplink, downlink, rate) VALUES %s",
+		strings.Join(placeholders, ", "),
+	)
+	return r.db.DB.Exec(sql, values...).Error
+}
+
+func (r *gormRepository) CreateNodeOnlineLog(log *NodeOnlineLog) error {
+	return r.db.DB.Create(log).Error
+}
+
+func (r *gormRepository) CreateOnlineIPs(ips []AliveIP) error {
+	for _, ip := range ips {
+		ip := ip
+		if err := r.db.DB.Create(&ip).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *gormRepository) UpdateUserTraffic(userIDs []uint, uplinkCase, downlinkCase string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	return r.db.DB.Table("user").
+		Where("id in (?)", userIDs).
+		Updates(map[string]interface{}{
+			"u": gorm.Expr(fmt.Sprintf("CASE id %s END", uplinkCase)),
+			"d": gorm.Expr(fmt.Sprintf("CASE id %s END", downlinkCase)),
+			"t": time.Now().Unix(),
+		}).Error
+}
+
+func (r *gormRepository) GetAllUsers(nodeID int) ([]UserModel, error) {
+	return r.db.GetAllUsers(nodeID)
+}
+
+func (r *gormRepository) GetUserQuotas(nodeID int) ([]UserQuota, error) {
+	return r.db.GetUserQuotas(nodeID)
+}
+
+func (r *gormRepository) GetNode(nodeID int) (*Node, error) {
+	return r.db.GetNode(nodeID)
+}
+
+func (r *gormRepository) MarkNodeOffline(nodeID int) error {
+	return r.db.DB.Model(&NodeInfo{}).
+		Where("node_id = ?", nodeID).
+		Update("online", false).Error
+}
@@ -0,0 +1,94 @@
+package ssrpanel
+
+// MockRepository is a hand-rolled Repository double for exercising Panel
+// without a live database. Each field is optional; a nil func falls back to
+// a zero-value, no-error response. The batches passed to
+// BatchCreateTrafficLogs and CreateOnlineIPs are recorded for assertions;
+// other calls are not.
+type MockRepository struct {
+	PingFunc                   func() error
+	CreateNodeInfoFunc         func(info *NodeInfo) error
+	BatchCreateTrafficLogsFunc func(logs []UserTrafficLog) error
+	CreateNodeOnlineLogFunc    func(log *NodeOnlineLog) error
+	CreateOnlineIPsFunc        func(ips []AliveIP) error
+	UpdateUserTrafficFunc      func(userIDs []uint, uplinkCase, downlinkCase string) error
+	GetAllUsersFunc            func(nodeID int) ([]UserModel, error)
+	GetUserQuotasFunc          func(nodeID int) ([]UserQuota, error)
+	GetNodeFunc                func(nodeID int) (*Node, error)
+	MarkNodeOfflineFunc        func(nodeID int) error
+
+	TrafficLogBatches [][]UserTrafficLog
+	OnlineIPBatches   [][]AliveIP
+}
+
+func (m *MockRepository) Ping() error {
+	if m.PingFunc != nil {
+		return m.PingFunc()
+	}
+	return nil
+}
+
+func (m *MockRepository) CreateNodeInfo(info *NodeInfo) error {
+	if m.CreateNodeInfoFunc != nil {
+		return m.CreateNodeInfoFunc(info)
+	}
+	return nil
+}
+
+func (m *MockRepository) BatchCreateTrafficLogs(logs []UserTrafficLog) error {
+	m.TrafficLogBatches = append(m.TrafficLogBatches, logs)
+	if m.BatchCreateTrafficLogsFunc != nil {
+		return m.BatchCreateTrafficLogsFunc(logs)
+	}
+	return nil
+}
+
+func (m *MockRepository) CreateNodeOnlineLog(log *NodeOnlineLog) error {
+	if m.CreateNodeOnlineLogFunc != nil {
+		return m.CreateNodeOnlineLogFunc(log)
+	}
+	return nil
+}
+
+func (m *MockRepository) CreateOnlineIPs(ips []AliveIP) error {
+	m.OnlineIPBatches = append(m.OnlineIPBatches, ips)
+	if m.CreateOnlineIPsFunc != nil {
+		return m.CreateOnlineIPsFunc(ips)
+	}
+	return nil
+}
+
+func (m *MockRepository) UpdateUserTraffic(userIDs []uint, uplinkCase, downlinkCase string) error {
+	if m.UpdateUserTrafficFunc != nil {
+		return m.UpdateUserTrafficFunc(userIDs, uplinkCase, downlinkCase)
+	}
+	return nil
+}
+
+func (m *MockRepository) GetAllUsers(nodeID int) ([]UserModel, error) {
+	if m.GetAllUsersFunc != nil {
+		return m.GetAllUsersFunc(nodeID)
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) GetUserQuotas(nodeID int) ([]UserQuota, error) {
+	if m.GetUserQuotasFunc != nil {
+		return m.GetUserQuotasFunc(nodeID)
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) GetNode(nodeID int) (*Node, error) {
+	if m.GetNodeFunc != nil {
+		return m.GetNodeFunc(nodeID)
+	}
+	return &Node{}, nil
+}
+
+func (m *MockRepository) MarkNodeOffline(nodeID int) error {
+	if m.MarkNodeOfflineFunc != nil {
+		return m.MarkNodeOfflineFunc(nodeID)
+	}
+	return nil
+}